@@ -0,0 +1,167 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+func TestConcatCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "concat.meta")
+	want := &concatCheckpoint{
+		TableName:             "headers",
+		SourcePath:            "/tmp/from",
+		DestHeadIdBefore:      3,
+		DestIndexSizeBefore:   128,
+		NextSourceFilenum:     1,
+		NextSourceIndexOffset: 10,
+	}
+	if err := writeConcatCheckpoint(path, want); err != nil {
+		t.Fatalf("writeConcatCheckpoint: %v", err)
+	}
+	got, err := readConcatCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readConcatCheckpoint: %v", err)
+	}
+	if *got != *want {
+		t.Fatalf("checkpoint = %+v, want %+v", got, want)
+	}
+}
+
+func TestConcatCheckpointMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "no-such-checkpoint")
+	cp, err := readConcatCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readConcatCheckpoint: %v", err)
+	}
+	if cp != nil {
+		t.Fatalf("expected nil checkpoint for missing file, got %+v", cp)
+	}
+}
+
+func TestConcatCheckpointOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "concat.meta")
+	if err := writeConcatCheckpoint(path, &concatCheckpoint{TableName: "headers", NextSourceFilenum: 1}); err != nil {
+		t.Fatalf("writeConcatCheckpoint: %v", err)
+	}
+	if err := writeConcatCheckpoint(path, &concatCheckpoint{TableName: "headers", NextSourceFilenum: 2}); err != nil {
+		t.Fatalf("writeConcatCheckpoint: %v", err)
+	}
+	got, err := readConcatCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readConcatCheckpoint: %v", err)
+	}
+	if got.NextSourceFilenum != 2 {
+		t.Fatalf("NextSourceFilenum = %d, want 2", got.NextSourceFilenum)
+	}
+}
+
+// writeInterruptedConcatCheckpoint simulates a Concat that renamed exactly
+// one of "from"'s data files into "to"'s directory and then crashed right
+// before flushing the corresponding index entries: it performs that one
+// rename and persists the checkpoint describing it, without touching
+// either table's index.
+func writeInterruptedConcatCheckpoint(t *testing.T, to, from *freezerTable) (cpPath string, movedDestFile string) {
+	t.Helper()
+
+	destHeadBefore := to.headId
+	srcFilenum := from.tailId
+	destFilenum := destHeadBefore + 1
+
+	if err := os.Rename(from.fileName(srcFilenum), to.fileName(destFilenum)); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	indexSize, err := to.index.Stat()
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	cp := &concatCheckpoint{
+		TableName:           "test",
+		SourcePath:          from.path,
+		DestHeadIdBefore:    destHeadBefore,
+		DestIndexSizeBefore: indexSize.Size(),
+		NextSourceFilenum:   srcFilenum,
+	}
+	cpPath = filepath.Join(to.path, "concat.meta")
+	if err := writeConcatCheckpoint(cpPath, cp); err != nil {
+		t.Fatalf("writeConcatCheckpoint: %v", err)
+	}
+	return cpPath, to.fileName(destFilenum)
+}
+
+func TestRecoverInterruptedConcatRollsBackRenamedFile(t *testing.T) {
+	to := newTestTable(t, 1)
+	fillTable(t, to, 2)
+	from := newTestTable(t, 1)
+	fillTable(t, from, 3)
+
+	srcFilenum := from.tailId
+	cpPath, movedDestFile := writeInterruptedConcatCheckpoint(t, to, from)
+
+	toFreezer := &freezer{tables: map[string]*freezerTable{"test": to}}
+	fromFreezer := &freezer{tables: map[string]*freezerTable{"test": from}}
+	if err := RecoverInterruptedConcat(toFreezer, fromFreezer); err != nil {
+		t.Fatalf("RecoverInterruptedConcat: %v", err)
+	}
+	if _, err := os.Stat(cpPath); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed after recovery")
+	}
+	if _, err := os.Stat(movedDestFile); !os.IsNotExist(err) {
+		t.Fatalf("renamed-in file still present in destination after rollback")
+	}
+	if _, err := os.Stat(from.fileName(srcFilenum)); err != nil {
+		t.Fatalf("file not restored to source: %v", err)
+	}
+}
+
+func TestRecoverInterruptedConcatAtOpen(t *testing.T) {
+	toDir, fromDir := t.TempDir(), t.TempDir()
+	to := newTestTableAt(t, toDir, 1)
+	fillTable(t, to, 2)
+	from := newTestTableAt(t, fromDir, 1)
+	fillTable(t, from, 3)
+
+	srcFilenum := from.tailId
+	cpPath, movedDestFile := writeInterruptedConcatCheckpoint(t, to, from)
+
+	// Simulate the crash and restart: close both tables, the way a
+	// process exit would leave them, before recovering purely from the
+	// destination directory.
+	if err := to.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := from.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := RecoverInterruptedConcatAtOpen(toDir, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, 1, true); err != nil {
+		t.Fatalf("RecoverInterruptedConcatAtOpen: %v", err)
+	}
+	if _, err := os.Stat(cpPath); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed after recovery")
+	}
+	if _, err := os.Stat(movedDestFile); !os.IsNotExist(err) {
+		t.Fatalf("renamed-in file still present in destination after rollback")
+	}
+	if _, err := os.Stat(from.fileName(srcFilenum)); err != nil {
+		t.Fatalf("file not restored to source: %v", err)
+	}
+}
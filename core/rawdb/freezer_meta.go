@@ -0,0 +1,93 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// freezerTableMeta is the metadata of a freezer table, persisted in a
+// "<name>.meta" file next to the table's index and data files.
+//
+// A data file can only ever be dropped as a whole, so TruncateTail cannot
+// always make the physical and logical tail of a table coincide: some
+// already-discarded items may still be sitting in the oldest surviving
+// data file. VirtualTail records the logical tail, and HiddenItems records
+// how many of the items in that file are hidden but not yet reclaimed.
+type freezerTableMeta struct {
+	VirtualTail uint64
+	HiddenItems uint64
+}
+
+// loadFreezerTableMeta reads the meta file for a freezer table. A table
+// that predates this file, or one that was just created, is treated as
+// having nothing hidden.
+func loadFreezerTableMeta(path string) (*freezerTableMeta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &freezerTableMeta{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var meta freezerTableMeta
+	if err := json.NewDecoder(file).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("corrupt freezer table meta %s: %v", path, err)
+	}
+	return &meta, nil
+}
+
+// store overwrites the meta file with m, fsync'ing both the file and its
+// parent directory before returning so that the new virtual tail is
+// durable, and the rename that put it in place is durable too, before any
+// index or data file is touched. The file is written to a temp file in the
+// same directory and renamed into place, so a crash mid-write can never
+// leave a half-written meta file behind.
+func (m *freezerTableMeta) store(path string) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
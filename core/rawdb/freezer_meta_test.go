@@ -0,0 +1,76 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreezerTableMetaRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.meta")
+	want := &freezerTableMeta{VirtualTail: 42, HiddenItems: 7}
+	if err := want.store(path); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	got, err := loadFreezerTableMeta(path)
+	if err != nil {
+		t.Fatalf("loadFreezerTableMeta: %v", err)
+	}
+	if *got != *want {
+		t.Fatalf("loaded meta = %+v, want %+v", got, want)
+	}
+}
+
+func TestFreezerTableMetaMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "does-not-exist.meta")
+	meta, err := loadFreezerTableMeta(path)
+	if err != nil {
+		t.Fatalf("loadFreezerTableMeta: %v", err)
+	}
+	if meta.VirtualTail != 0 || meta.HiddenItems != 0 {
+		t.Fatalf("expected zero-value meta for missing file, got %+v", meta)
+	}
+}
+
+func TestFreezerTableMetaCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corrupt.meta")
+	if err := ioutil.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := loadFreezerTableMeta(path); err == nil {
+		t.Fatalf("expected error loading corrupt meta file")
+	}
+}
+
+func TestFreezerTableMetaStoreOverwrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.meta")
+	if err := (&freezerTableMeta{VirtualTail: 1}).store(path); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if err := (&freezerTableMeta{VirtualTail: 2, HiddenItems: 3}).store(path); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	got, err := loadFreezerTableMeta(path)
+	if err != nil {
+		t.Fatalf("loadFreezerTableMeta: %v", err)
+	}
+	if got.VirtualTail != 2 || got.HiddenItems != 3 {
+		t.Fatalf("loaded meta = %+v, want {2 3}", got)
+	}
+}
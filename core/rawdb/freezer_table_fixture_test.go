@@ -0,0 +1,55 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// newTestTable builds a standalone freezerTable in a fresh temp directory,
+// for exercising TruncateTail/TruncateHead/Append/concat in isolation. It
+// goes through openTable, not newTable directly, so every test also
+// exercises the open-time tail-meta recovery a real freezer relies on.
+func newTestTable(t *testing.T, maxFileSize uint32) *freezerTable {
+	t.Helper()
+	return newTestTableAt(t, t.TempDir(), maxFileSize)
+}
+
+// newTestTableAt is like newTestTable but opens the table at an
+// already-chosen directory, so a test can close and reopen it to simulate
+// a restart.
+func newTestTableAt(t *testing.T, dir string, maxFileSize uint32) *freezerTable {
+	t.Helper()
+	table, err := openTable(dir, "test", metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, maxFileSize, true, false)
+	if err != nil {
+		t.Fatalf("openTable: %v", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+// fillTable appends n one-byte items to table.
+func fillTable(t *testing.T, table *freezerTable, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := table.Append([]byte{byte(i)}); err != nil {
+			t.Fatalf("Append(%d): %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errOutOfBounds is returned by table read paths when the requested item
+// has already been discarded by TruncateTail, was never written (at or
+// beyond the head), or - for a file lookup - names a data file that
+// TruncateTail has physically removed.
+var errOutOfBounds = errors.New("out of bounds")
+
+// freezerTableMaxFileSize is the default cap on the size of a single data
+// file within a freezer table. Once a table's head file would grow past
+// this, it is rolled over to a new, higher-numbered file instead.
+const freezerTableMaxFileSize = 2 * 1024 * 1024 * 1024 // 2 GiB
+
+// readFile returns the data file holding fileNum, for use by Retrieve. The
+// current head is always open for read/write and is returned directly;
+// every older file is opened read-only, lazily, and cached in t.files so
+// that reads never block on, or are blocked by, appends to the head.
+func (t *freezerTable) readFile(fileNum uint32) (*os.File, error) {
+	t.lock.RLock()
+	if fileNum < t.tailId {
+		// TruncateTail has already removed this file from disk; opening
+		// it would otherwise surface a raw "no such file" error instead
+		// of the caller-facing errOutOfBounds.
+		t.lock.RUnlock()
+		return nil, errOutOfBounds
+	}
+	if fileNum == t.headId {
+		f := t.head
+		t.lock.RUnlock()
+		return f, nil
+	}
+	if f, ok := t.files[fileNum]; ok {
+		t.lock.RUnlock()
+		return f, nil
+	}
+	t.lock.RUnlock()
+
+	f, err := openFreezerFileForReadOnly(t.fileName(fileNum))
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if existing, ok := t.files[fileNum]; ok {
+		// Lost the race to open it; use the existing one and drop ours.
+		f.Close()
+		return existing, nil
+	}
+	if t.files == nil {
+		t.files = make(map[uint32]*os.File)
+	}
+	t.files[fileNum] = f
+	return f, nil
+}
+
+// Append adds item to the end of the table, rolling the head file over to a
+// new, higher-numbered file first if item wouldn't otherwise fit within
+// t.maxFileSize. The new item is always written whole into a single data
+// file; it is never split across a rollover.
+//
+// Only the bookkeeping around a rollover and the index/size update need to
+// exclude readers: the write into the head file itself only advances that
+// file's own write cursor and does not touch anything readFile or a
+// concurrent ReadAt depends on, so it runs without holding t.lock. This is
+// what lets readFile's RLock go through while a large item is being
+// written, instead of queuing up behind the whole Append.
+func (t *freezerTable) Append(item []byte) error {
+	t.lock.Lock()
+	if t.headBytes > 0 && t.headBytes+int64(len(item)) > int64(t.maxFileSize) {
+		if err := t.rolloverHeadLocked(); err != nil {
+			t.lock.Unlock()
+			return err
+		}
+	}
+	head, headId := t.head, t.headId
+	t.lock.Unlock()
+
+	if _, err := head.Write(item); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.headBytes += int64(len(item))
+
+	entry := indexEntry{filenum: headId, offset: uint32(t.headBytes)}
+	if _, err := t.index.Write(entry.append(nil)); err != nil {
+		return err
+	}
+	t.items++
+	return nil
+}
+
+// TruncateHead discards every item in the table numbered at or above items,
+// the mirror image of TruncateTail. Any data file left with no surviving
+// items is closed and removed outright; files can only be dropped whole, so
+// a data file that still holds at least one surviving item is kept even
+// though part of it is now unused.
+func (t *freezerTable) TruncateHead(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if items >= t.itemOffset+t.items {
+		return nil
+	}
+	if items < t.itemOffset {
+		return fmt.Errorf("freezer table %s: truncate head %d below tail %d", t.name, items, t.itemOffset)
+	}
+	newItems := items - t.itemOffset
+
+	entry, err := readIndex(t, newItems)
+	if err != nil {
+		return err
+	}
+	if err := truncateFreezerFile(t.index, int64((newItems+1)*indexEntrySize)); err != nil {
+		return err
+	}
+
+	if entry.filenum != t.headId {
+		// The surviving head now lives in a file that used to be an
+		// older, read-only pooled file. Drop the old write-mode head,
+		// reclaim everything above it, and reopen the surviving file
+		// for writing.
+		oldHeadId := t.headId
+		if err := t.head.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(t.fileName(oldHeadId)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing truncated head file %s: %v", t.fileName(oldHeadId), err)
+		}
+		if err := t.releaseFilesAboveLocked(entry.filenum); err != nil {
+			return err
+		}
+		if pooled, ok := t.files[entry.filenum]; ok {
+			if err := pooled.Close(); err != nil {
+				return err
+			}
+			delete(t.files, entry.filenum)
+		}
+		head, err := openFreezerFileForAppend(t.fileName(entry.filenum))
+		if err != nil {
+			return err
+		}
+		t.head = head
+	} else if err := t.releaseFilesAboveLocked(entry.filenum); err != nil {
+		return err
+	}
+
+	if err := truncateFreezerFile(t.head, int64(entry.offset)); err != nil {
+		return err
+	}
+	t.headId = entry.filenum
+	t.headBytes = int64(entry.offset)
+	t.items = newItems
+	return nil
+}
+
+// rolloverHeadLocked closes the current head file for writing, reopens it
+// read-only into the file pool, and starts a new, empty head file one id
+// higher. It is called from Append whenever the next item would push the
+// head file past t.maxFileSize. Callers must hold t.lock.
+func (t *freezerTable) rolloverHeadLocked() error {
+	oldHeadId := t.headId
+	oldHead := t.head
+
+	newHeadId := oldHeadId + 1
+	newHead, err := openFreezerFileTruncated(t.fileName(newHeadId))
+	if err != nil {
+		return err
+	}
+	readonly, err := openFreezerFileForReadOnly(t.fileName(oldHeadId))
+	if err != nil {
+		newHead.Close()
+		return err
+	}
+	if t.files == nil {
+		t.files = make(map[uint32]*os.File)
+	}
+	t.files[oldHeadId] = readonly
+	oldHead.Close()
+
+	t.head = newHead
+	t.headId = newHeadId
+	t.headBytes = 0
+	return nil
+}
+
+// poolReadonly opens fileNum read-only and adds it to the table's file
+// pool, so that concurrent readers can find it under the read lock without
+// requiring the table to be reopened. It is a no-op if the id is already
+// the head or already pooled, which lets callers like concat call it
+// unconditionally after every file they move into place.
+func (t *freezerTable) poolReadonly(fileNum uint32) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if fileNum == t.headId {
+		return nil
+	}
+	if _, ok := t.files[fileNum]; ok {
+		return nil
+	}
+	f, err := openFreezerFileForReadOnly(t.fileName(fileNum))
+	if err != nil {
+		return err
+	}
+	if t.files == nil {
+		t.files = make(map[uint32]*os.File)
+	}
+	t.files[fileNum] = f
+	return nil
+}
+
+// releaseFilesAboveLocked closes and removes every pooled data file with an
+// id strictly greater than id. It is called from TruncateHead once the
+// index has been shortened, to drop the now-orphaned tail of rolled-over
+// files. Callers must hold t.lock.
+func (t *freezerTable) releaseFilesAboveLocked(id uint32) error {
+	for fileNum, f := range t.files {
+		if fileNum <= id {
+			continue
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		delete(t.files, fileNum)
+		if err := os.Remove(t.fileName(fileNum)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing truncated data file %s: %v", t.fileName(fileNum), err)
+		}
+	}
+	return nil
+}
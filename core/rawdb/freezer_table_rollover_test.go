@@ -0,0 +1,121 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countDataFiles returns the number of ".rdat" data files present in dir.
+func countDataFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	count := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".rdat") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestTruncateHeadRemovesFilesAboveSurvivingHead(t *testing.T) {
+	// One item per file forces TruncateHead to cross file boundaries and
+	// replace the write-mode head, which is the path that used to leak
+	// the old head file.
+	table := newTestTable(t, 1)
+	fillTable(t, table, 5)
+
+	if got, want := countDataFiles(t, table.path), 5; got != want {
+		t.Fatalf("data files before truncate = %d, want %d", got, want)
+	}
+	if err := table.TruncateHead(2); err != nil {
+		t.Fatalf("TruncateHead: %v", err)
+	}
+	if got, want := countDataFiles(t, table.path), int(table.headId)+1; got != want {
+		t.Fatalf("data files after truncate = %d, want %d", got, want)
+	}
+	if _, err := os.Stat(table.fileName(4)); !os.IsNotExist(err) {
+		t.Fatalf("former head file 4 should have been removed, stat err = %v", err)
+	}
+}
+
+// TestAppendAndReadFileConcurrently stresses Append running concurrently
+// with readFile. It is run with -race in CI; the fixed timeout also catches
+// the case this is guarding against, namely Append holding its lock across
+// the whole write and so starving readers for the duration of the run.
+func TestAppendAndReadFileConcurrently(t *testing.T) {
+	table := newTestTable(t, 4096)
+	fillTable(t, table, 10)
+
+	const appends = 2000
+	const readers = 8
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < appends; i++ {
+			if err := table.Append([]byte{byte(i)}); err != nil {
+				t.Errorf("Append(%d): %v", i, err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				table.lock.RLock()
+				headId := table.headId
+				table.lock.RUnlock()
+				if _, err := table.readFile(headId); err != nil {
+					t.Errorf("readFile(%d): %v", headId, err)
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Append/readFile stress test deadlocked")
+	}
+}
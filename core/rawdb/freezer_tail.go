@@ -0,0 +1,202 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// metaName returns the path of the table's metadata file.
+func (t *freezerTable) metaName() string {
+	return filepath.Join(t.path, t.name+".meta")
+}
+
+// recoverTailMeta reloads the table's persisted tail metadata and replays
+// TruncateTail up to the recorded virtual tail. TruncateTail is idempotent
+// with respect to its own previous runs, so this is safe to call
+// unconditionally right after a table is opened: it is a no-op if the last
+// TruncateTail completed cleanly before close, and it finishes the job if a
+// crash interrupted one between persisting the new meta file and shifting
+// the index or dropping the newly-hidden data files. Without this, a table
+// that predates a reopen silently un-hides items a prior TruncateTail had
+// already discarded.
+func (t *freezerTable) recoverTailMeta() error {
+	meta, err := loadFreezerTableMeta(t.metaName())
+	if err != nil {
+		return err
+	}
+	if meta.VirtualTail == 0 {
+		return nil
+	}
+	return t.TruncateTail(meta.VirtualTail)
+}
+
+// openTable opens a freezer table via newTable and then replays any
+// TruncateTail interrupted by a crash, via recoverTailMeta. This is the
+// entry point the freezer constructor is expected to use for every table,
+// in place of calling newTable directly, so that a table reopened after a
+// restart never exposes items a prior TruncateTail already hid.
+func openTable(path, name string, readMeter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFileSize uint32, disableSnappy, readonly bool) (*freezerTable, error) {
+	t, err := newTable(path, name, readMeter, writeMeter, sizeGauge, maxFileSize, disableSnappy, readonly)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.recoverTailMeta(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkItemVisibleLocked reports whether item is still a live member of the
+// table: not below the virtual tail (hidden by TruncateTail, whether or not
+// its data file has physically been dropped yet) and not at or beyond the
+// head. Retrieve and the other read paths must call this, under t.lock,
+// before translating item into an index/data file lookup, returning
+// errOutOfBounds if it fails.
+func (t *freezerTable) checkItemVisibleLocked(item uint64) error {
+	if item < t.itemOffset+t.itemHidden || item >= t.itemOffset+t.items {
+		return errOutOfBounds
+	}
+	return nil
+}
+
+// TruncateTail discards all items in the table numbered below n, moving the
+// table's logical tail forward. Unlike TruncateHead, this does not always
+// free disk space immediately: a data file can only be dropped once every
+// item it holds has been discarded, so any discarded items at the front of
+// the oldest surviving data file are left in place, hidden, until a later
+// TruncateTail moves the tail past the end of that file.
+func (t *freezerTable) TruncateTail(n uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if n <= t.itemOffset+t.itemHidden {
+		// Already truncated at least this far.
+		return nil
+	}
+	if n > t.itemOffset+t.items {
+		return fmt.Errorf("freezer table %s: tail %d exceeds head %d", t.name, n, t.itemOffset+t.items)
+	}
+	// newTail is the index, relative to the first entry of the current
+	// index file, of the item that becomes the new tail.
+	newTail := n - t.itemOffset
+
+	// Persist the new virtual tail before changing anything else. If the
+	// process dies right after this, the table reopens with the index and
+	// data files untouched, and the stale prefix is simply hidden again.
+	meta := &freezerTableMeta{VirtualTail: n}
+	if err := meta.store(t.metaName()); err != nil {
+		return err
+	}
+
+	// Read the index entry of the new tail item to find the file that now
+	// contains it.
+	targetEntry, err := readIndex(t, newTail)
+	if err != nil {
+		return err
+	}
+	targetFile := targetEntry.filenum
+
+	// Every data file strictly below targetFile is now entirely hidden and
+	// can be dropped whole.
+	for fileNum := t.tailId; fileNum < targetFile; fileNum++ {
+		if err := os.Remove(t.fileName(fileNum)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Find the first index entry that still belongs to a surviving file,
+	// and shift the index down so it starts there.
+	firstKept := newTail
+	for firstKept > 0 {
+		entry, err := readIndex(t, firstKept-1)
+		if err != nil {
+			return err
+		}
+		if entry.filenum != targetFile {
+			break
+		}
+		firstKept--
+	}
+	// copyFromSync renames a freshly-written file over the index's path; it
+	// does not, and cannot, affect the long-lived t.index handle, which
+	// would otherwise keep referring to the old, now-unlinked inode. Close
+	// it and open a new handle on the same path so every read/append after
+	// this point sees the shifted content.
+	indexPath := t.index.Name()
+	if err := copyFromSync(indexPath, indexPath, firstKept*indexEntrySize, nil, true); err != nil {
+		return err
+	}
+	if err := t.index.Close(); err != nil {
+		return err
+	}
+	newIndex, err := openFreezerFileForAppend(indexPath)
+	if err != nil {
+		return err
+	}
+	t.index = newIndex
+
+	// Update in-memory and on-disk bookkeeping: the items hidden at the
+	// front of the surviving file, and the new tail file id.
+	meta.HiddenItems = newTail - firstKept
+	if err := meta.store(t.metaName()); err != nil {
+		return err
+	}
+	t.tailId = targetFile
+	t.itemOffset += firstKept
+	t.items -= firstKept
+	t.itemHidden = meta.HiddenItems
+
+	return nil
+}
+
+// TruncateTail discards all items with a number lower than n across every
+// table of the freezer, moving the ancient store's logical tail forward.
+func (f *freezer) TruncateTail(n uint64) error {
+	for name, table := range f.tables {
+		if err := table.TruncateTail(n); err != nil {
+			return fmt.Errorf("truncating tail of table %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Tail returns the number of the oldest item still retrievable from the
+// freezer.
+func (f *freezer) Tail() (uint64, error) {
+	return f.tables["headers"].itemOffset + f.tables["headers"].itemHidden, nil
+}
+
+// Ancients returns the number of items the freezer currently holds, i.e.
+// one past the highest retrievable item number.
+func (f *freezer) Ancients() (uint64, error) {
+	t := f.tables["headers"]
+	return t.itemOffset + t.items, nil
+}
+
+// ItemAmountInAncient returns the number of items still retrievable from the
+// freezer, i.e. Ancients() minus Tail(). Items hidden behind the virtual
+// tail but not yet physically removed are not counted.
+func (f *freezer) ItemAmountInAncient() (uint64, error) {
+	t := f.tables["headers"]
+	return t.items - t.itemHidden, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestTruncateTailKeepsItemCountInSync(t *testing.T) {
+	table := newTestTable(t, 1024*1024)
+	fillTable(t, table, 10)
+
+	headBefore := table.itemOffset + table.items
+	if err := table.TruncateTail(6); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+	if got := table.itemOffset + table.items; got != headBefore {
+		t.Fatalf("itemOffset+items changed across TruncateTail: got %d, want %d", got, headBefore)
+	}
+}
+
+func TestTruncateTailPersistsVirtualTail(t *testing.T) {
+	table := newTestTable(t, 1024*1024)
+	fillTable(t, table, 5)
+
+	if err := table.TruncateTail(3); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+	meta, err := loadFreezerTableMeta(table.metaName())
+	if err != nil {
+		t.Fatalf("loadFreezerTableMeta: %v", err)
+	}
+	if meta.VirtualTail != 3 {
+		t.Fatalf("VirtualTail = %d, want 3", meta.VirtualTail)
+	}
+}
+
+func TestTruncateTailRejectsBeyondHead(t *testing.T) {
+	table := newTestTable(t, 1024*1024)
+	fillTable(t, table, 3)
+
+	if err := table.TruncateTail(10); err == nil {
+		t.Fatalf("expected error truncating tail past head")
+	}
+}
+
+func TestTruncateTailIsIdempotent(t *testing.T) {
+	table := newTestTable(t, 1024*1024)
+	fillTable(t, table, 5)
+
+	if err := table.TruncateTail(3); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+	tailAfterFirst := table.itemOffset + table.itemHidden
+
+	if err := table.TruncateTail(2); err != nil {
+		t.Fatalf("TruncateTail with an already-passed tail: %v", err)
+	}
+	if got := table.itemOffset + table.itemHidden; got != tailAfterFirst {
+		t.Fatalf("a no-op TruncateTail moved the tail: got %d, want %d", got, tailAfterFirst)
+	}
+}
+
+func TestTruncateTailRecoversFromInterruptedMetaOnReopen(t *testing.T) {
+	// One item per file so that a virtual tail of 3 requires files 0-2 to
+	// be dropped and the index to be shifted - the part of TruncateTail
+	// that a crash could leave undone.
+	dir := t.TempDir()
+	table := newTestTableAt(t, dir, 1)
+	fillTable(t, table, 5)
+
+	// Simulate a crash between steps 1 and 2 of TruncateTail: the new
+	// virtual tail has been fsync'ed to the meta file, but the index and
+	// data files haven't been touched yet.
+	if err := (&freezerTableMeta{VirtualTail: 3}).store(table.metaName()); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if err := table.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened := newTestTableAt(t, dir, 1)
+	if got := reopened.itemOffset + reopened.itemHidden; got != 3 {
+		t.Fatalf("virtual tail after recovery = %d, want 3", got)
+	}
+	for _, fileNum := range []uint32{0, 1, 2} {
+		if _, err := os.Stat(reopened.fileName(fileNum)); !os.IsNotExist(err) {
+			t.Fatalf("file %d should have been removed by recovered truncate, stat err = %v", fileNum, err)
+		}
+	}
+}
+
+func TestCheckItemVisibleLockedRejectsHiddenAndFutureItems(t *testing.T) {
+	table := newTestTable(t, 1024*1024)
+	fillTable(t, table, 5)
+
+	if err := table.TruncateTail(3); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+
+	table.lock.RLock()
+	defer table.lock.RUnlock()
+
+	if err := table.checkItemVisibleLocked(2); !errors.Is(err, errOutOfBounds) {
+		t.Fatalf("item 2 (hidden by tail): got %v, want errOutOfBounds", err)
+	}
+	if err := table.checkItemVisibleLocked(3); err != nil {
+		t.Fatalf("item 3 (first visible): got %v, want nil", err)
+	}
+	if err := table.checkItemVisibleLocked(4); err != nil {
+		t.Fatalf("item 4 (last written): got %v, want nil", err)
+	}
+	if err := table.checkItemVisibleLocked(5); !errors.Is(err, errOutOfBounds) {
+		t.Fatalf("item 5 (at head): got %v, want errOutOfBounds", err)
+	}
+}
+
+func TestReadFileRejectsFilesRemovedByTailTruncation(t *testing.T) {
+	// One item per file so TruncateTail actually removes file 0 from
+	// disk, not just shifts the index.
+	table := newTestTable(t, 1)
+	fillTable(t, table, 5)
+
+	if err := table.TruncateTail(3); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+	if _, err := table.readFile(0); !errors.Is(err, errOutOfBounds) {
+		t.Fatalf("readFile(0): got %v, want errOutOfBounds", err)
+	}
+}
+
+func TestTruncateTailIndexUsableAfterShift(t *testing.T) {
+	// One item per file forces the index shift in TruncateTail to
+	// actually move entries, not just no-op over an empty prefix.
+	table := newTestTable(t, 1)
+	fillTable(t, table, 5)
+
+	if err := table.TruncateTail(3); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+
+	// Read back the new tail item through the still-open table: if
+	// t.index still pointed at the old, unshifted inode this would
+	// return the entry for the original, already-discarded item 0.
+	entry, err := readIndex(table, 0)
+	if err != nil {
+		t.Fatalf("readIndex(0): %v", err)
+	}
+	if entry.filenum != table.tailId {
+		t.Fatalf("readIndex(0).filenum = %d, want %d (table.tailId)", entry.filenum, table.tailId)
+	}
+
+	// Append another item through the same handle: if t.index still
+	// pointed at the orphaned pre-shift inode, this write - and the
+	// table's own notion of how many items it holds - would silently
+	// diverge from what's actually readable on disk.
+	itemsBefore := table.items
+	if err := table.Append([]byte{42}); err != nil {
+		t.Fatalf("Append after TruncateTail: %v", err)
+	}
+	if table.items != itemsBefore+1 {
+		t.Fatalf("items after Append = %d, want %d", table.items, itemsBefore+1)
+	}
+	newEntry, err := readIndex(table, table.items-1)
+	if err != nil {
+		t.Fatalf("readIndex(%d) for appended item: %v", table.items-1, err)
+	}
+	if newEntry.filenum != table.headId {
+		t.Fatalf("appended entry filenum = %d, want %d (table.headId)", newEntry.filenum, table.headId)
+	}
+}
+
+func TestTruncateTailDropsWholeFilesOnly(t *testing.T) {
+	// One item per file forces every truncated item to live in its own
+	// data file, so TruncateTail must actually remove files, not just
+	// shift the index.
+	table := newTestTable(t, 1)
+	fillTable(t, table, 5)
+
+	if err := table.TruncateTail(3); err != nil {
+		t.Fatalf("TruncateTail: %v", err)
+	}
+	if table.itemOffset+table.items != 5 {
+		t.Fatalf("itemOffset+items = %d, want 5", table.itemOffset+table.items)
+	}
+	if table.itemOffset+table.itemHidden < 3 {
+		t.Fatalf("virtual tail regressed: itemOffset=%d itemHidden=%d, want >= 3", table.itemOffset, table.itemHidden)
+	}
+}
@@ -18,6 +18,7 @@ package rawdb
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -25,6 +26,7 @@ import (
 	"path/filepath"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 )
 
 // copyFrom copies data from 'srcPath' at offset 'offset' into 'destPath'.
@@ -33,6 +35,14 @@ import (
 // manipulate the dest file.
 // It is perfectly valid to have destPath == srcPath.
 func copyFrom(srcPath, destPath string, offset uint64, before func(f *os.File) error) error {
+	return copyFromSync(srcPath, destPath, offset, before, false)
+}
+
+// copyFromSync behaves like copyFrom, but if fsync is true it also fsyncs
+// the new file before the rename and its parent directory afterwards, so
+// that a crash immediately after this call returns can never observe a torn
+// or missing destPath.
+func copyFromSync(srcPath, destPath string, offset uint64, before func(f *os.File) error, fsync bool) error {
 	// Create a temp file in the same dir where we want it to wind up
 	f, err := ioutil.TempFile(filepath.Dir(destPath), "*")
 	if err != nil {
@@ -74,6 +84,11 @@ func copyFrom(srcPath, destPath string, offset uint64, before func(f *os.File) e
 	// we do the final move.
 	src.Close()
 
+	if fsync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
@@ -82,11 +97,33 @@ func copyFrom(srcPath, destPath string, offset uint64, before func(f *os.File) e
 	if err := os.Rename(fname, destPath); err != nil {
 		return err
 	}
+	if fsync {
+		if err := syncDir(filepath.Dir(destPath)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// openFreezerFileForAppend opens a freezer table file and seeks to the end
+// syncDir opens dir and fsyncs it, which on most platforms is what commits a
+// preceding rename or create within that directory to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// openFreezerFileForAppend opens a freezer table file and seeks to the end.
+// If this call is what creates the file, the directory entry is fsync'ed
+// before returning, so the file's existence survives a crash even before
+// anything has been written to it.
 func openFreezerFileForAppend(filename string) (*os.File, error) {
+	_, statErr := os.Stat(filename)
+	isNew := os.IsNotExist(statErr)
+
 	// Open the file without the O_APPEND flag
 	// because it has differing behaviour during Truncate operations
 	// on different OS's
@@ -94,6 +131,12 @@ func openFreezerFileForAppend(filename string) (*os.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	if isNew {
+		if err := syncDir(filepath.Dir(filename)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 	// Seek to end for append
 	if _, err = file.Seek(0, io.SeekEnd); err != nil {
 		return nil, err
@@ -111,11 +154,17 @@ func openFreezerFileTruncated(filename string) (*os.File, error) {
 	return os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 }
 
-// truncateFreezerFile resizes a freezer table file and seeks to the end
+// truncateFreezerFile resizes a freezer table file and seeks to the end.
+// The new size is fsync'ed before returning, so a truncation that is meant
+// to shrink away now-invalid data can't be undone by a crash that resurrects
+// the old, larger size.
 func truncateFreezerFile(file *os.File, size int64) error {
 	if err := file.Truncate(size); err != nil {
 		return err
 	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
 	// Seek to end for append
 	if _, err := file.Seek(0, io.SeekEnd); err != nil {
 		return err
@@ -123,18 +172,211 @@ func truncateFreezerFile(file *os.File, size int64) error {
 	return nil
 }
 
+// concatCheckpoint is the crash-recovery record for an in-progress Concat.
+// It is written, fsync'ed, to "<destpath>/concat.meta" before a table's
+// data files start moving, and updated after every source-file rename and
+// index flush, so that on reopen the freezer always finds either no
+// checkpoint (nothing in flight) or one that precisely describes how far
+// the previous attempt got.
+type concatCheckpoint struct {
+	TableName             string
+	SourcePath            string
+	DestHeadIdBefore      uint32
+	DestIndexSizeBefore   int64
+	NextSourceFilenum     uint32
+	NextSourceIndexOffset uint64
+}
+
+// concatCheckpointPath returns where the checkpoint of a Concat into "to"
+// lives. Every table of a freezer shares the freezer's directory, so any
+// one of them gives it.
+func concatCheckpointPath(to *freezer) string {
+	for _, table := range to.tables {
+		return filepath.Join(table.path, "concat.meta")
+	}
+	return ""
+}
+
+func readConcatCheckpoint(path string) (*concatCheckpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var cp concatCheckpoint
+	if err := json.NewDecoder(file).Decode(&cp); err != nil {
+		return nil, fmt.Errorf("corrupt concat checkpoint %s: %v", path, err)
+	}
+	return &cp, nil
+}
+
+func writeConcatCheckpoint(path string, cp *concatCheckpoint) error {
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resumeConcat rolls back a Concat that was interrupted partway through
+// copying table cp.TableName: the destination index is truncated back to
+// its pre-concat size, and any data file already renamed into the
+// destination is moved back to its original name in the source freezer.
+func resumeConcat(to, from *freezer, cp *concatCheckpoint) error {
+	totab, ok := to.tables[cp.TableName]
+	if !ok {
+		return fmt.Errorf("concat checkpoint refers to unknown table %s", cp.TableName)
+	}
+	fromtab, ok := from.tables[cp.TableName]
+	if !ok {
+		return fmt.Errorf("concat checkpoint refers to unknown table %s", cp.TableName)
+	}
+	log.Warn("Rolling back interrupted freezer concat", "table", cp.TableName)
+
+	if err := truncateFreezerFile(totab.index, cp.DestIndexSizeBefore); err != nil {
+		return err
+	}
+	// Every destination file beyond DestHeadIdBefore was renamed in from a
+	// source file by this concat, in strictly increasing source-file-id
+	// order starting at the source table's tail file (concat never changes
+	// the source index, so its tailId is still the first file it moved;
+	// cp.NextSourceFilenum already points past the files moved so far).
+	// Once we've renamed back as many files as "from" ever had (its id
+	// range runs up to headId), any further destination file is not one of
+	// ours to touch: it can only be a file "to" rolled over to on its own,
+	// concurrently with the concat.
+	srcId := fromtab.tailId
+	for id := cp.DestHeadIdBefore + 1; ; id++ {
+		destFile := totab.fileName(id)
+		if _, err := os.Stat(destFile); err != nil {
+			break
+		}
+		if srcId > fromtab.headId {
+			break
+		}
+		if err := os.Rename(destFile, fromtab.fileName(srcId)); err != nil {
+			return err
+		}
+		srcId++
+	}
+	return nil
+}
+
+// RecoverInterruptedConcat rolls back an interrupted Concat, if the
+// checkpoint for one is found in to's directory. It is meant to be called
+// during freezer open, before any table is touched, so that a process
+// restart alone (without a fresh Concat call) is enough to recover; Concat
+// itself also calls this at its own start, to cover the case where it is
+// invoked again directly after a crash.
+func RecoverInterruptedConcat(to, from *freezer) error {
+	cp, err := readConcatCheckpoint(concatCheckpointPath(to))
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		return nil
+	}
+	if err := resumeConcat(to, from, cp); err != nil {
+		return fmt.Errorf("recovering interrupted concat: %v", err)
+	}
+	return os.Remove(concatCheckpointPath(to))
+}
+
+// RecoverInterruptedConcatAtOpen is the open-time counterpart of
+// RecoverInterruptedConcat: given just a destination directory, it checks
+// for a leftover concat checkpoint and, if one exists, reopens only the one
+// table it names - in both the destination and the recorded source path -
+// to roll the interrupted copy back, before removing the checkpoint. The
+// freezer constructor is expected to call this for its directory before
+// opening any of its tables for normal use, so that a bare process restart
+// after a crash mid-Concat is enough to recover, with no need to already
+// have a live source freezer on hand.
+func RecoverInterruptedConcatAtOpen(destPath string, readMeter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFileSize uint32, disableSnappy bool) error {
+	cp, err := readConcatCheckpoint(filepath.Join(destPath, "concat.meta"))
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		return nil
+	}
+	totab, err := newTable(destPath, cp.TableName, readMeter, writeMeter, sizeGauge, maxFileSize, disableSnappy, false)
+	if err != nil {
+		return fmt.Errorf("reopening destination table %s for concat recovery: %v", cp.TableName, err)
+	}
+	defer totab.Close()
+
+	fromtab, err := newTable(cp.SourcePath, cp.TableName, readMeter, writeMeter, sizeGauge, maxFileSize, disableSnappy, false)
+	if err != nil {
+		return fmt.Errorf("reopening source table %s for concat recovery: %v", cp.TableName, err)
+	}
+	defer fromtab.Close()
+
+	to := &freezer{tables: map[string]*freezerTable{cp.TableName: totab}}
+	from := &freezer{tables: map[string]*freezerTable{cp.TableName: fromtab}}
+	return RecoverInterruptedConcat(to, from)
+}
+
+// Concat backfills "to" with all the ancient data found in "from", moving
+// "from"'s data files into "to"'s directory and finally swapping "to" into
+// place as the live ancient store. It is crash-safe: progress is tracked in
+// a checkpoint file, so a process that dies mid-backfill can always
+// recover, either on the next Concat call (handled here) or, given only the
+// destination directory, through RecoverInterruptedConcatAtOpen.
 func Concat(to, from *freezer) error {
+	cpPath := concatCheckpointPath(to)
+	if err := RecoverInterruptedConcat(to, from); err != nil {
+		return err
+	}
+
 	for name, totab := range to.tables {
 		log.Debug("backfilling ancients", "table", name)
 		fromtab, ok := from.tables[name]
 		if !ok {
 			return fmt.Errorf("table %s not in source freezer", name)
 		}
-		err := concat(totab, fromtab)
+		indexSize, err := totab.index.Stat()
 		if err != nil {
+			return err
+		}
+		cp := &concatCheckpoint{
+			TableName:           name,
+			SourcePath:          fromtab.path,
+			DestHeadIdBefore:    totab.headId,
+			DestIndexSizeBefore: indexSize.Size(),
+			NextSourceFilenum:   fromtab.tailId,
+		}
+		if err := writeConcatCheckpoint(cpPath, cp); err != nil {
+			return fmt.Errorf("writing concat checkpoint: %v", err)
+		}
+		if err := concat(totab, fromtab, cpPath, cp); err != nil {
 			return fmt.Errorf("concatenating tables %s: %s", name, err)
 		}
 	}
+	if err := os.Remove(cpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
 	toPath := to.tables["headers"].path
 	fromPath := from.tables["headers"].path
@@ -157,7 +399,7 @@ func readIndex(t *freezerTable, i uint64) (*indexEntry, error) {
 	return entry, nil
 }
 
-func concat(to, from *freezerTable) error {
+func concat(to, from *freezerTable, cpPath string, cp *concatCheckpoint) error {
 	index, err := openFreezerFileForAppend(to.index.Name())
 	if err != nil {
 		return err
@@ -183,10 +425,35 @@ func concat(to, from *freezerTable) error {
 			if err := os.Rename(from.fileName(fromFileId), to.fileName(toFileId)); err != nil {
 				return err
 			}
+			if err := syncDir(filepath.Dir(to.fileName(toFileId))); err != nil {
+				return err
+			}
+			// Pool the renamed file as an extra, read-only data file of
+			// "to" straight away, rather than waiting for a reopen: "to"'s
+			// own head file is untouched by any of this, so reads against
+			// the file numbers we've just moved in must keep working.
+			if err := to.poolReadonly(toFileId); err != nil {
+				return err
+			}
 			if fromFileId != entry.filenum+1 {
 				return fmt.Errorf("unexpected jump from %d to %d", entry.filenum, fromFileId)
 			}
 			fromFileId = entry.filenum
+
+			// A data file just moved and the index entries describing it
+			// are about to be flushed; persist a checkpoint of exactly
+			// this point so a crash from here on can be rolled back.
+			if err := toIndex.Flush(); err != nil {
+				return err
+			}
+			if err := index.Sync(); err != nil {
+				return err
+			}
+			cp.NextSourceFilenum = fromFileId
+			cp.NextSourceIndexOffset = cur
+			if err := writeConcatCheckpoint(cpPath, cp); err != nil {
+				return err
+			}
 		}
 		entry.filenum = toFileId
 		if _, err := toIndex.Write(entry.append(nil)); err != nil {
@@ -197,6 +464,9 @@ func concat(to, from *freezerTable) error {
 	if err := toIndex.Flush(); err != nil {
 		return err
 	}
+	if err := index.Sync(); err != nil {
+		return err
+	}
 	if err := index.Close(); err != nil {
 		return err
 	}
@@ -205,5 +475,24 @@ func concat(to, from *freezerTable) error {
 	if err := os.Rename(from.fileName(fromFileId), to.fileName(toFileId)); err != nil {
 		return err
 	}
+	if err := syncDir(filepath.Dir(to.fileName(toFileId))); err != nil {
+		return err
+	}
+	return to.poolReadonly(toFileId)
+}
+
+// SyncAncient fsyncs the head and index files of every table in the
+// freezer, fanning the sync out across the whole ancient store so callers
+// like block import or tail truncation can force durability at well-defined
+// checkpoints instead of relying on the OS to flush eventually.
+func (f *freezer) SyncAncient() error {
+	for name, table := range f.tables {
+		if err := table.head.Sync(); err != nil {
+			return fmt.Errorf("syncing head of table %s: %v", name, err)
+		}
+		if err := table.index.Sync(); err != nil {
+			return fmt.Errorf("syncing index of table %s: %v", name, err)
+		}
+	}
 	return nil
 }